@@ -0,0 +1,64 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package polymur provides the gateway's debugging API server.
+package polymur
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/chrissnell/polymur/pool"
+)
+
+// Api serves debugging endpoints describing the gateway's runtime
+// state on addr.
+func Api(p *pool.Pool, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ring", ringHandler(p))
+
+	log.Printf("polymur: api serving on %s", addr)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("polymur: api: %s", err)
+	}
+}
+
+// ringStatus is the /ring endpoint's JSON response: the ring's vnode
+// density and each destination's current in-flight queue depth.
+type ringStatus struct {
+	VnodesPerDestination int            `json:"vnodes_per_destination"`
+	Destinations         map[string]int `json:"destinations"`
+}
+
+func ringHandler(p *pool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vnodes, load := p.RingMembership()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ringStatus{
+			VnodesPerDestination: vnodes,
+			Destinations:         load,
+		})
+	}
+}
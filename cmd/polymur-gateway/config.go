@@ -0,0 +1,446 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/chrissnell/polymur/keysync"
+	"github.com/chrissnell/polymur/listener"
+	"github.com/chrissnell/polymur/output"
+	"github.com/chrissnell/polymur/pool"
+	"gopkg.in/yaml.v2"
+)
+
+// fileConfig is the schema for -config's YAML file. Every field mirrors
+// a CLI flag (nested under a subsection for vault/consul/acme/oidc).
+type fileConfig struct {
+	ListenAddr   string   `yaml:"listen-addr"`
+	ListenPort   string   `yaml:"listen-port"`
+	ApiAddr      string   `yaml:"api-addr"`
+	StatAddr     string   `yaml:"stat-addr"`
+	QueueCap     int      `yaml:"queue-cap"`
+	Console      bool     `yaml:"console-out"`
+	Destinations string   `yaml:"destinations"`
+	MetricsFlush int      `yaml:"metrics-flush"`
+	Distribution string   `yaml:"distribution"`
+	HashEpsilon  *float64 `yaml:"hash-epsilon"`
+	Cert         string   `yaml:"cert"`
+	Key          string   `yaml:"key"`
+	CACert       string   `yaml:"ca-cert"`
+	UseCertAuth  bool     `yaml:"use-cert-auth"`
+	DevMode      bool     `yaml:"dev-mode"`
+	KeyPrefix    bool     `yaml:"key-prefix"`
+	KeyStore     string   `yaml:"key-store"`
+
+	Vault struct {
+		Mount    string `yaml:"mount"`
+		Path     string `yaml:"path"`
+		RoleID   string `yaml:"role-id"`
+		SecretID string `yaml:"secret-id"`
+	} `yaml:"vault"`
+
+	Consul struct {
+		Addr string `yaml:"addr"`
+	} `yaml:"consul"`
+
+	Acme struct {
+		Enabled  bool   `yaml:"enabled"`
+		Hosts    string `yaml:"hosts"`
+		CacheDir string `yaml:"cache-dir"`
+		Cache    string `yaml:"cache"`
+		HTTP     bool   `yaml:"http"`
+	} `yaml:"acme"`
+
+	Oidc struct {
+		Enabled         bool   `yaml:"enabled"`
+		Issuer          string `yaml:"issuer"`
+		Audience        string `yaml:"audience"`
+		AllowedSubjects string `yaml:"allowed-subjects"`
+	} `yaml:"oidc"`
+}
+
+// loadConfigFile reads, parses, and validates the YAML file at path.
+func loadConfigFile(path string) (*fileConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %s", path, err)
+	}
+
+	var cfg fileConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+
+	if err := validateConfig(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return &cfg, nil
+}
+
+// validateConfig rejects a config whose required fields are missing or
+// whose auth modes conflict, so a bad -config (or a bad reload) is
+// refused atomically rather than leaving the gateway half-configured.
+func validateConfig(cfg *fileConfig) error {
+	switch cfg.Distribution {
+	case "", "broadcast", "hash-route", "legacy-hash":
+	default:
+		return fmt.Errorf("distribution must be one of broadcast, hash-route, legacy-hash, got %q", cfg.Distribution)
+	}
+
+	if cfg.HashEpsilon != nil && *cfg.HashEpsilon < 0 {
+		return fmt.Errorf("hash-epsilon must be >= 0, got %v", *cfg.HashEpsilon)
+	}
+
+	if cfg.UseCertAuth && cfg.Oidc.Enabled {
+		return fmt.Errorf("use-cert-auth and oidc.enabled are mutually exclusive")
+	}
+
+	if cfg.Oidc.Enabled && (cfg.Oidc.Issuer == "" || cfg.Oidc.Audience == "") {
+		return fmt.Errorf("oidc.issuer and oidc.audience are required when oidc.enabled is true")
+	}
+
+	if cfg.KeyStore != "" && cfg.KeyStore != "consul" && cfg.KeyStore != "vault" {
+		return fmt.Errorf("key-store must be consul or vault, got %q", cfg.KeyStore)
+	}
+
+	return nil
+}
+
+// explicitFlags returns the set of flag names passed on argv, so
+// applyConfigFile can tell an explicit CLI override (which must win)
+// apart from an untouched default (which the config file may set).
+func explicitFlags(args []string) map[string]bool {
+	set := make(map[string]bool)
+
+	for _, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		name := strings.TrimLeft(a, "-")
+		if eq := strings.IndexByte(name, '='); eq >= 0 {
+			name = name[:eq]
+		}
+		set[name] = true
+	}
+
+	return set
+}
+
+func orDefault(v, fallback string) string {
+	if v == "" {
+		return fallback
+	}
+	return v
+}
+
+// applyConfigFile copies cfg's fields onto options, for every field
+// whose corresponding flag wasn't explicitly set on argv.
+func applyConfigFile(cfg *fileConfig, explicit map[string]bool) {
+	set := func(name string, assign func()) {
+		if !explicit[name] {
+			assign()
+		}
+	}
+
+	set("listen-addr", func() { options.addr = orDefault(cfg.ListenAddr, options.addr) })
+	set("listen-port", func() { options.port = orDefault(cfg.ListenPort, options.port) })
+	set("api-addr", func() { options.apiAddr = orDefault(cfg.ApiAddr, options.apiAddr) })
+	set("stat-addr", func() { options.statAddr = orDefault(cfg.StatAddr, options.statAddr) })
+	set("queue-cap", func() {
+		if cfg.QueueCap > 0 {
+			options.queuecap = cfg.QueueCap
+		}
+	})
+	set("console-out", func() { options.console = cfg.Console })
+	set("destinations", func() { options.destinations = orDefault(cfg.Destinations, options.destinations) })
+	set("metrics-flush", func() { options.metricsFlush = cfg.MetricsFlush })
+	set("distribution", func() { options.distribution = orDefault(cfg.Distribution, options.distribution) })
+	set("hash-epsilon", func() {
+		if cfg.HashEpsilon != nil {
+			options.hashEpsilon = *cfg.HashEpsilon
+		}
+	})
+	set("cert", func() { options.cert = orDefault(cfg.Cert, options.cert) })
+	set("key", func() { options.key = orDefault(cfg.Key, options.key) })
+	set("ca-cert", func() { options.ca = orDefault(cfg.CACert, options.ca) })
+	set("use-cert-auth", func() { options.useCertAuthentication = cfg.UseCertAuth })
+	set("dev-mode", func() { options.devMode = cfg.DevMode })
+	set("key-prefix", func() { options.keyPrefix = cfg.KeyPrefix })
+	set("key-store", func() { options.keyStore = orDefault(cfg.KeyStore, options.keyStore) })
+
+	set("vault-mount", func() { options.vaultMount = orDefault(cfg.Vault.Mount, options.vaultMount) })
+	set("vault-path", func() { options.vaultPath = orDefault(cfg.Vault.Path, options.vaultPath) })
+	set("vault-role-id", func() { options.vaultRoleID = orDefault(cfg.Vault.RoleID, options.vaultRoleID) })
+	set("vault-secret-id", func() { options.vaultSecretID = orDefault(cfg.Vault.SecretID, options.vaultSecretID) })
+
+	set("consul-addr", func() { options.consulAddr = orDefault(cfg.Consul.Addr, options.consulAddr) })
+
+	set("acme", func() { options.acme = cfg.Acme.Enabled })
+	set("acme-hosts", func() { options.acmeHosts = orDefault(cfg.Acme.Hosts, options.acmeHosts) })
+	set("acme-cache-dir", func() { options.acmeCacheDir = orDefault(cfg.Acme.CacheDir, options.acmeCacheDir) })
+	set("acme-cache", func() { options.acmeCache = orDefault(cfg.Acme.Cache, options.acmeCache) })
+	set("acme-http", func() { options.acmeHTTP = cfg.Acme.HTTP })
+
+	set("use-oidc-auth", func() { options.useOIDCAuth = cfg.Oidc.Enabled })
+	set("oidc-issuer", func() { options.oidcIssuer = orDefault(cfg.Oidc.Issuer, options.oidcIssuer) })
+	set("oidc-audience", func() { options.oidcAudience = orDefault(cfg.Oidc.Audience, options.oidcAudience) })
+	set("oidc-allowed-subjects", func() {
+		options.oidcAllowedSubjects = orDefault(cfg.Oidc.AllowedSubjects, options.oidcAllowedSubjects)
+	})
+}
+
+// reloadState bundles the running components a SIGHUP reload is
+// allowed to touch: the destination pool, the hash-route epsilon,
+// KeyPrefix, the OIDC verifier's allowed subjects, and the key sync
+// backend. Every other option (listen addr/port, api-addr, stat-addr,
+// queue-cap, console-out, metrics-flush, distribution, TLS cert/key/ca,
+// use-cert-auth, dev-mode, acme.*, use-oidc-auth, oidc-issuer/audience)
+// is wired into a listener or output loop by value at startup and is
+// not reloadable; reloadConfig restores any of them a reload attempts
+// to change, as reported by nonReloadableDiff.
+type reloadState struct {
+	pool         *pool.Pool
+	hashEpsilon  *output.AtomicEpsilon
+	keyPrefix    *listener.AtomicBool
+	oidcVerifier *listener.OIDCVerifier
+	apiKeys      *keysync.ApiKeys
+
+	keysyncCancel context.CancelFunc
+}
+
+// reloadConfig re-reads path and applies its hot-reloadable fields to
+// state without dropping in-flight connections. Called from
+// runControl on SIGHUP.
+func reloadConfig(path string, explicit map[string]bool, state *reloadState) {
+	before := options
+
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		log.Printf("config reload: rejected: %s", err)
+		return
+	}
+
+	applyConfigFile(cfg, explicit)
+
+	if ignored := nonReloadableDiff(before, options); len(ignored) > 0 {
+		log.Printf("config reload: ignoring change to non-reloadable fields: %s", strings.Join(ignored, ", "))
+		options.addr = before.addr
+		options.port = before.port
+		options.apiAddr = before.apiAddr
+		options.statAddr = before.statAddr
+		options.queuecap = before.queuecap
+		options.console = before.console
+		options.metricsFlush = before.metricsFlush
+		options.distribution = before.distribution
+		options.cert = before.cert
+		options.key = before.key
+		options.ca = before.ca
+		options.useCertAuthentication = before.useCertAuthentication
+		options.devMode = before.devMode
+		options.acme = before.acme
+		options.acmeHosts = before.acmeHosts
+		options.acmeCacheDir = before.acmeCacheDir
+		options.acmeCache = before.acmeCache
+		options.acmeHTTP = before.acmeHTTP
+		options.useOIDCAuth = before.useOIDCAuth
+		options.oidcIssuer = before.oidcIssuer
+		options.oidcAudience = before.oidcAudience
+	}
+
+	changed := applyReload(state, before)
+	if len(changed) == 0 {
+		log.Printf("config reload: no reloadable fields changed")
+		return
+	}
+
+	log.Printf("config reload: applied: %s", strings.Join(changed, ", "))
+}
+
+// applyReload pushes every changed, reloadable field in options (as
+// compared against before) onto the live components in state, and
+// returns the list of fields it applied.
+func applyReload(state *reloadState, before optionsT) []string {
+	var changed []string
+
+	if options.destinations != before.destinations {
+		reconcileDestinations(state.pool, before.destinations, options.destinations, options.queuecap)
+		changed = append(changed, "destinations")
+	}
+
+	if options.hashEpsilon != before.hashEpsilon {
+		state.hashEpsilon.Set(options.hashEpsilon)
+		changed = append(changed, "hash-epsilon")
+	}
+
+	if options.keyPrefix != before.keyPrefix {
+		state.keyPrefix.Set(options.keyPrefix)
+		changed = append(changed, "key-prefix")
+	}
+
+	if options.useOIDCAuth && state.oidcVerifier != nil && options.oidcAllowedSubjects != before.oidcAllowedSubjects {
+		if err := state.oidcVerifier.SetAllowedSubjects(options.oidcAllowedSubjects); err != nil {
+			log.Printf("config reload: rejected oidc-allowed-subjects change: %s", err)
+		} else {
+			changed = append(changed, "oidc-allowed-subjects")
+		}
+	}
+
+	usesKeySync := !options.useCertAuthentication && !options.useOIDCAuth && !options.devMode
+	if usesKeySync && state.apiKeys != nil &&
+		(options.keyStore != before.keyStore || options.vaultMount != before.vaultMount ||
+			options.vaultPath != before.vaultPath || options.consulAddr != before.consulAddr ||
+			options.vaultRoleID != before.vaultRoleID || options.vaultSecretID != before.vaultSecretID) {
+		if err := restartKeysync(state); err != nil {
+			log.Printf("config reload: rejected key-store change: %s", err)
+		} else {
+			changed = append(changed, "key-store mount/path")
+		}
+	}
+
+	return changed
+}
+
+// nonReloadableDiff reports which non-reloadable fields a config
+// reload attempted to change, so they can be logged and ignored. Only
+// the fields applyReload knows how to push onto live components
+// (destinations, hash-epsilon, key-prefix, oidc-allowed-subjects, and
+// the key sync backend's keyStore/vaultMount/vaultPath/vaultRoleID/
+// vaultSecretID/consulAddr) are reloadable; every other field is wired
+// into a listener or output
+// loop by value at startup, so a reload that changes it would leave
+// options and the running gateway disagreeing about its state.
+func nonReloadableDiff(before, after optionsT) []string {
+	var ignored []string
+
+	if before.addr != after.addr {
+		ignored = append(ignored, "listen-addr")
+	}
+	if before.port != after.port {
+		ignored = append(ignored, "listen-port")
+	}
+	if before.apiAddr != after.apiAddr {
+		ignored = append(ignored, "api-addr")
+	}
+	if before.statAddr != after.statAddr {
+		ignored = append(ignored, "stat-addr")
+	}
+	if before.queuecap != after.queuecap {
+		ignored = append(ignored, "queue-cap")
+	}
+	if before.console != after.console {
+		ignored = append(ignored, "console-out")
+	}
+	if before.metricsFlush != after.metricsFlush {
+		ignored = append(ignored, "metrics-flush")
+	}
+	if before.distribution != after.distribution {
+		ignored = append(ignored, "distribution")
+	}
+	if before.cert != after.cert || before.key != after.key || before.ca != after.ca {
+		ignored = append(ignored, "cert/key/ca-cert")
+	}
+	if before.useCertAuthentication != after.useCertAuthentication {
+		ignored = append(ignored, "use-cert-auth")
+	}
+	if before.devMode != after.devMode {
+		ignored = append(ignored, "dev-mode")
+	}
+	if before.acme != after.acme || before.acmeHosts != after.acmeHosts ||
+		before.acmeCacheDir != after.acmeCacheDir || before.acmeCache != after.acmeCache ||
+		before.acmeHTTP != after.acmeHTTP {
+		ignored = append(ignored, "acme.*")
+	}
+	if before.useOIDCAuth != after.useOIDCAuth {
+		ignored = append(ignored, "use-oidc-auth")
+	}
+	if before.oidcIssuer != after.oidcIssuer || before.oidcAudience != after.oidcAudience {
+		ignored = append(ignored, "oidc-issuer/oidc-audience")
+	}
+
+	return ignored
+}
+
+// reconcileDestinations diffs the old and new static destinations
+// lists and adds/removes only what changed, leaving untouched
+// destinations' connections (and in-flight queues) alone. It's a
+// no-op for consul:// destination URLs, which are reconciled by their
+// own pool.Discoverer instead.
+func reconcileDestinations(p *pool.Pool, oldList, newList string, queueCap int) {
+	if _, isConsul, _ := pool.ParseConsulDestinationURL(newList); isConsul {
+		return
+	}
+
+	old := splitDestinations(oldList)
+	next := splitDestinations(newList)
+
+	for addr := range old {
+		if !next[addr] {
+			output.RemoveDestination(p, addr)
+		}
+	}
+
+	for addr := range next {
+		if !old[addr] {
+			output.AddDestination(p, addr, queueCap)
+		}
+	}
+}
+
+func splitDestinations(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			set[addr] = true
+		}
+	}
+	return set
+}
+
+// restartKeysync tears down the running key sync backend and starts a
+// new one built from the current options, so -key-store, -vault-mount,
+// -vault-path, -vault-role-id, -vault-secret-id, and -consul-addr can
+// change without a gateway restart.
+func restartKeysync(state *reloadState) error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	backend, err := newKeysyncBackend(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	if state.keysyncCancel != nil {
+		state.keysyncCancel()
+	}
+	state.keysyncCancel = cancel
+
+	go keysync.Run(ctx, state.apiKeys, backend)
+
+	return nil
+}
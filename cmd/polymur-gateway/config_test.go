@@ -0,0 +1,171 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/chrissnell/polymur/keysync"
+	"github.com/chrissnell/polymur/listener"
+	"github.com/chrissnell/polymur/output"
+	"github.com/chrissnell/polymur/pool"
+)
+
+func TestValidateConfig(t *testing.T) {
+	epsilon := -1.0
+
+	cases := []struct {
+		name    string
+		cfg     fileConfig
+		wantErr bool
+	}{
+		{"empty is valid", fileConfig{}, false},
+		{"valid distribution", fileConfig{Distribution: "hash-route"}, false},
+		{"invalid distribution", fileConfig{Distribution: "round-robin"}, true},
+		{"negative hash-epsilon", fileConfig{HashEpsilon: &epsilon}, true},
+		{"invalid key-store", fileConfig{KeyStore: "etcd"}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateConfig(&c.cfg)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("validateConfig(%+v) error = %v, wantErr %v", c.cfg, err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateConfigOidcMutuallyExclusive(t *testing.T) {
+	cfg := fileConfig{UseCertAuth: true}
+	cfg.Oidc.Enabled = true
+	cfg.Oidc.Issuer = "https://issuer.example"
+	cfg.Oidc.Audience = "aud"
+
+	if err := validateConfig(&cfg); err == nil {
+		t.Fatal("expected error for use-cert-auth + oidc.enabled both set")
+	}
+}
+
+func TestValidateConfigOidcRequiresIssuerAndAudience(t *testing.T) {
+	cfg := fileConfig{}
+	cfg.Oidc.Enabled = true
+
+	if err := validateConfig(&cfg); err == nil {
+		t.Fatal("expected error for oidc.enabled without issuer/audience")
+	}
+}
+
+func TestExplicitFlags(t *testing.T) {
+	args := []string{"-listen-addr=0.0.0.0", "--dev-mode", "-queue-cap", "100"}
+	set := explicitFlags(args)
+
+	for _, name := range []string{"listen-addr", "dev-mode", "queue-cap"} {
+		if !set[name] {
+			t.Errorf("explicitFlags(%v) missing %q", args, name)
+		}
+	}
+	if set["distribution"] {
+		t.Errorf("explicitFlags(%v) unexpectedly set %q", args, "distribution")
+	}
+}
+
+func TestNonReloadableDiff(t *testing.T) {
+	before := optionsT{addr: "0.0.0.0", port: "443", distribution: "broadcast"}
+	after := before
+	after.port = "8443"
+	after.distribution = "hash-route"
+	after.destinations = "changed:this:is:reloadable"
+
+	ignored := nonReloadableDiff(before, after)
+
+	want := map[string]bool{"listen-port": true, "distribution": true}
+	if len(ignored) != len(want) {
+		t.Fatalf("nonReloadableDiff = %v, want entries for %v", ignored, want)
+	}
+	for _, field := range ignored {
+		if !want[field] {
+			t.Errorf("nonReloadableDiff reported unexpected field %q", field)
+		}
+	}
+}
+
+func TestNonReloadableDiffNoChange(t *testing.T) {
+	before := optionsT{addr: "0.0.0.0", destinations: "a:1,b:1"}
+	after := before
+	after.destinations = "a:1,b:1,c:1"
+
+	if ignored := nonReloadableDiff(before, after); len(ignored) != 0 {
+		t.Fatalf("nonReloadableDiff = %v, want none for a reloadable-only change", ignored)
+	}
+}
+
+func TestApplyConfigFileSkipsExplicitFlags(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	options = optionsT{addr: "0.0.0.0", distribution: "broadcast"}
+	cfg := &fileConfig{ListenAddr: "10.0.0.1", Distribution: "hash-route"}
+	explicit := map[string]bool{"listen-addr": true}
+
+	applyConfigFile(cfg, explicit)
+
+	if options.addr != "0.0.0.0" {
+		t.Errorf("applyConfigFile overwrote explicitly-set listen-addr: got %q", options.addr)
+	}
+	if options.distribution != "hash-route" {
+		t.Errorf("applyConfigFile did not apply unset distribution: got %q", options.distribution)
+	}
+}
+
+func TestApplyReloadRestartsKeysyncOnVaultCredentialChange(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	options = optionsT{keyStore: "consul", consulAddr: "localhost:8500"}
+	before := options
+	options.vaultRoleID = "new-role-id"
+
+	state := &reloadState{
+		pool:         pool.NewPool(),
+		hashEpsilon:  output.NewAtomicEpsilon(0.25),
+		keyPrefix:    listener.NewAtomicBool(false),
+		oidcVerifier: nil,
+		apiKeys:      keysync.NewApiKeys(),
+	}
+
+	changed := applyReload(state, before)
+
+	found := false
+	for _, field := range changed {
+		if field == "key-store mount/path" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("applyReload(%v) = %v, want a key-store restart for a vault-role-id-only change", before, changed)
+	}
+	if state.keysyncCancel == nil {
+		t.Fatal("applyReload did not install a keysyncCancel after restarting the key sync backend")
+	}
+}
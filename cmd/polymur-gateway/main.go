@@ -22,9 +22,12 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/chrissnell/polymur"
@@ -37,24 +40,47 @@ import (
 	"github.com/namsral/flag"
 )
 
+// optionsT holds every gateway setting, populated from defaults, then
+// env vars, then an optional -config YAML file, then explicit CLI flags
+// (each overriding the last). Named so a config reload can snapshot it
+// by value to diff against.
+type optionsT struct {
+	addr                  string
+	port                  string
+	apiAddr               string
+	statAddr              string
+	queuecap              int
+	console               bool
+	destinations          string
+	metricsFlush          int
+	distribution          string
+	hashEpsilon           float64
+	cert                  string
+	key                   string
+	useCertAuthentication bool
+	ca                    string
+	devMode               bool
+	keyPrefix             bool
+	keyStore              string
+	consulAddr            string
+	vaultMount            string
+	vaultPath             string
+	vaultRoleID           string
+	vaultSecretID         string
+	acme                  bool
+	acmeHosts             string
+	acmeCacheDir          string
+	acmeCache             string
+	acmeHTTP              bool
+	useOIDCAuth           bool
+	oidcIssuer            string
+	oidcAudience          string
+	oidcAllowedSubjects   string
+	configPath            string
+}
+
 var (
-	options struct {
-		addr                  string
-		port                  string
-		apiAddr               string
-		statAddr              string
-		queuecap              int
-		console               bool
-		destinations          string
-		metricsFlush          int
-		distribution          string
-		cert                  string
-		key                   string
-		useCertAuthentication bool
-		ca                    string
-		devMode               bool
-		keyPrefix             bool
-	}
+	options optionsT
 
 	sigChan = make(chan os.Signal)
 )
@@ -68,22 +94,73 @@ func init() {
 	flag.BoolVar(&options.console, "console-out", false, "Dump output to console")
 	flag.StringVar(&options.destinations, "destinations", "", "Comma-delimited list of ip:port destinations")
 	flag.IntVar(&options.metricsFlush, "metrics-flush", 0, "Graphite flush interval for runtime metrics (0 is disabled)")
-	flag.StringVar(&options.distribution, "distribution", "broadcast", "Destination distribution methods: broadcast, hash-route")
+	flag.StringVar(&options.distribution, "distribution", "broadcast", "Destination distribution methods: broadcast, hash-route, legacy-hash")
+	flag.Float64Var(&options.hashEpsilon, "hash-epsilon", 0.25, "Allowed fractional imbalance above the mean in-flight load before hash-route probes the next ring node")
 	flag.StringVar(&options.cert, "cert", "", "TLS Certificate")
 	flag.StringVar(&options.key, "key", "", "TLS Key")
 	flag.StringVar(&options.ca, "ca-cert", "", "CA Cert (for certificate-based authentication)")
 	flag.BoolVar(&options.useCertAuthentication, "use-cert-auth", false, "Use TLS certificate-based authentication in lieu of API keys")
-	flag.BoolVar(&options.devMode, "dev-mode", false, "Dev mode: disables Consul API key store; uses '123'")
+	flag.BoolVar(&options.devMode, "dev-mode", false, "Dev mode: disables the -key-store backend; uses '123'. Supersedes -key-store if both are set")
 	flag.BoolVar(&options.keyPrefix, "key-prefix", false, "If enabled, prepends all metrics with the origin polymur-proxy API key's name")
+	flag.StringVar(&options.keyStore, "key-store", "consul", "API key store backend: consul, vault. Ignored if -dev-mode is set")
+	flag.StringVar(&options.consulAddr, "consul-addr", "", "Consul HTTP API address for the consul key store")
+	flag.StringVar(&options.vaultMount, "vault-mount", "secret", "Vault KV v2 mount point for the vault key store")
+	flag.StringVar(&options.vaultPath, "vault-path", "polymur/keys", "Vault path under -vault-mount holding one secret per API key")
+	flag.StringVar(&options.vaultRoleID, "vault-role-id", "", "Vault AppRole role ID (alternative to VAULT_TOKEN)")
+	flag.StringVar(&options.vaultSecretID, "vault-secret-id", "", "Vault AppRole secret ID (alternative to VAULT_TOKEN)")
+	flag.BoolVar(&options.acme, "acme", false, "Use ACME (e.g. Let's Encrypt) to automatically issue and renew the TLS certificate instead of -cert/-key")
+	flag.StringVar(&options.acmeHosts, "acme-hosts", "", "Comma-delimited list of hostnames ACME is allowed to issue certificates for")
+	flag.StringVar(&options.acmeCacheDir, "acme-cache-dir", "", "Directory to cache ACME account/certificate data in")
+	flag.StringVar(&options.acmeCache, "acme-cache", "", "ACME cache backend, e.g. consul://localhost:8500 to store cache data in Consul KV instead of -acme-cache-dir")
+	flag.BoolVar(&options.acmeHTTP, "acme-http", true, "Serve the ACME HTTP-01 challenge responder on :80; if false, use tls-alpn-01 only")
+	flag.BoolVar(&options.useOIDCAuth, "use-oidc-auth", false, "Use OIDC bearer-token authentication in lieu of API keys or client certificates")
+	flag.StringVar(&options.oidcIssuer, "oidc-issuer", "", "OIDC issuer URL, e.g. https://accounts.google.com")
+	flag.StringVar(&options.oidcAudience, "oidc-audience", "", "Expected OIDC token audience")
+	flag.StringVar(&options.oidcAllowedSubjects, "oidc-allowed-subjects", "", "Comma-delimited list or regex of allowed OIDC token subjects")
+	flag.StringVar(&options.configPath, "config", "", "Path to a YAML config file; overrides env vars, explicit CLI flags still take precedence. Re-read on SIGHUP")
 	flag.Parse()
 }
 
-// Handles signal events.
-func runControl() {
+// newKeysyncBackend constructs the keysync.Backend selected by
+// -key-store. ctx bounds the lifetime of any background goroutine the
+// backend starts (e.g. VaultBackend's token-renewal loop).
+func newKeysyncBackend(ctx context.Context) (keysync.Backend, error) {
+	switch options.keyStore {
+	case "vault":
+		return keysync.NewVaultBackend(ctx, &keysync.VaultBackendConfig{
+			Mount:    options.vaultMount,
+			Path:     options.vaultPath,
+			RoleID:   options.vaultRoleID,
+			SecretID: options.vaultSecretID,
+		})
+	case "consul":
+		return keysync.NewConsulBackend(&keysync.ConsulBackendConfig{
+			Addr: options.consulAddr,
+		})
+	default:
+		return nil, fmt.Errorf("unknown -key-store %q: must be consul or vault", options.keyStore)
+	}
+}
+
+// runControl handles signal events: SIGINT shuts the gateway down,
+// SIGHUP re-reads -config and hot-reloads it (see reloadConfig).
+func runControl(configPath string, explicit map[string]bool, reload *reloadState) {
 	signal.Notify(sigChan, syscall.SIGINT)
-	<-sigChan
-	log.Printf("Shutting down")
-	os.Exit(0)
+
+	hup := make(chan os.Signal, 1)
+	if configPath != "" {
+		signal.Notify(hup, syscall.SIGHUP)
+	}
+
+	for {
+		select {
+		case <-sigChan:
+			log.Printf("Shutting down")
+			os.Exit(0)
+		case <-hup:
+			reloadConfig(configPath, explicit, reload)
+		}
+	}
 }
 
 func main() {
@@ -91,16 +168,36 @@ func main() {
 
 	log.Println("::: Polymur-gateway :::")
 
+	explicit := explicitFlags(os.Args[1:])
+	if options.configPath != "" {
+		cfg, err := loadConfigFile(options.configPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		applyConfigFile(cfg, explicit)
+	}
+
 	if options.useCertAuthentication && options.cert == "" {
 		log.Fatalln("Cannot use certificate-based authentication without supplying a cert via -cert")
 	}
 
+	if options.useOIDCAuth && (options.oidcIssuer == "" || options.oidcAudience == "") {
+		log.Fatalln("Cannot use OIDC authentication without -oidc-issuer and -oidc-audience")
+	}
+
+	if options.devMode && explicit["key-store"] {
+		log.Printf("-dev-mode supersedes -key-store=%s; the configured key store backend will not be used", options.keyStore)
+	}
+
 	ready := make(chan bool, 1)
 
 	incomingQueue := make(chan []*string, 32768)
 
 	pool := pool.NewPool()
 
+	hashEpsilon := output.NewAtomicEpsilon(options.hashEpsilon)
+	keyPrefix := listener.NewAtomicBool(options.keyPrefix)
+
 	// Output writer.
 	if options.console {
 		go output.Console(incomingQueue)
@@ -113,6 +210,7 @@ func main() {
 				Distribution:  options.distribution,
 				IncomingQueue: incomingQueue,
 				QueueCap:      options.queuecap,
+				HashEpsilon:   hashEpsilon,
 			},
 			ready)
 	}
@@ -123,17 +221,49 @@ func main() {
 	sentCntr := &statstracker.Stats{}
 	go statstracker.StatsTracker(pool, sentCntr)
 
-	// Only start the key sync service if we're using key-based authentication
-	if !options.useCertAuthentication {
+	var keysyncCancel context.CancelFunc
+
+	// Only start the key sync service if we're using key-based authentication.
+	if !options.useCertAuthentication && !options.useOIDCAuth {
 		// API key sync service.
 		apiKeys = keysync.NewApiKeys()
 		if !options.devMode {
-			go keysync.Run(apiKeys)
+			var ctx context.Context
+			ctx, keysyncCancel = context.WithCancel(context.Background())
+
+			backend, err := newKeysyncBackend(ctx)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			go keysync.Run(ctx, apiKeys, backend)
 		} else {
 			apiKeys.Keys["123"] = "dev"
 		}
 	}
 
+	var oidcVerifier *listener.OIDCVerifier
+	if options.useOIDCAuth {
+		var err error
+		oidcVerifier, err = listener.NewOIDCVerifier(context.Background(), &listener.OIDCVerifierConfig{
+			Issuer:          options.oidcIssuer,
+			Audience:        options.oidcAudience,
+			AllowedSubjects: options.oidcAllowedSubjects,
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	var acmeHosts []string
+	if options.acmeHosts != "" {
+		acmeHosts = strings.Split(options.acmeHosts, ",")
+	}
+
+	var acmeCacheConsulAddr string
+	if strings.HasPrefix(options.acmeCache, "consul://") {
+		acmeCacheConsulAddr = strings.TrimPrefix(options.acmeCache, "consul://")
+	}
+
 	// HTTP Listener.
 	go listener.HTTPListener(&listener.HTTPListenerConfig{
 		Addr:          options.addr,
@@ -142,10 +272,17 @@ func main() {
 		Cert:          options.cert,
 		CA:            options.ca,
 		UseCertAuthentication: options.useCertAuthentication,
-		KeyPrefix:             options.keyPrefix,
+		KeyPrefix:             keyPrefix,
+		UseOIDCAuth:           options.useOIDCAuth,
+		OIDCVerifier:          oidcVerifier,
 		Key:                   options.key,
 		Stats:                 sentCntr,
 		Keys:                  apiKeys,
+		ACME:                 options.acme,
+		ACMEHosts:            acmeHosts,
+		ACMECacheDir:         options.acmeCacheDir,
+		ACMECacheConsulAddr:  acmeCacheConsulAddr,
+		ACMEHTTP:             options.acmeHTTP,
 	})
 
 	// API listener.
@@ -159,5 +296,12 @@ func main() {
 	// Runtime stats listener.
 	go runstats.Start(options.statAddr)
 
-	runControl()
+	runControl(options.configPath, explicit, &reloadState{
+		pool:          pool,
+		hashEpsilon:   hashEpsilon,
+		keyPrefix:     keyPrefix,
+		oidcVerifier:  oidcVerifier,
+		apiKeys:       apiKeys,
+		keysyncCancel: keysyncCancel,
+	})
 }
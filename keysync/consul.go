@@ -0,0 +1,129 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package keysync
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ConsulBackendConfig configures a ConsulBackend.
+type ConsulBackendConfig struct {
+	// Addr is the Consul HTTP API address, e.g. "localhost:8500". Empty
+	// defers to the client's default (CONSUL_HTTP_ADDR or
+	// localhost:8500).
+	Addr string
+	// Prefix is the KV path under which each key is stored, one per
+	// entry, value being the owning name.
+	Prefix string
+}
+
+// ConsulBackend reads API keys from a Consul KV tree.
+type ConsulBackend struct {
+	client *api.Client
+	prefix string
+}
+
+// NewConsulBackend returns a Backend backed by Consul's KV store.
+func NewConsulBackend(cfg *ConsulBackendConfig) (*ConsulBackend, error) {
+	conf := api.DefaultConfig()
+	if cfg.Addr != "" {
+		conf.Address = cfg.Addr
+	}
+
+	client, err := api.NewClient(conf)
+	if err != nil {
+		return nil, fmt.Errorf("keysync: consul client: %s", err)
+	}
+
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = "polymur/keys/"
+	}
+
+	return &ConsulBackend{client: client, prefix: prefix}, nil
+}
+
+// Fetch lists the current key/name pairs under c.prefix.
+func (c *ConsulBackend) Fetch(ctx context.Context) (map[string]string, error) {
+	pairs, _, err := c.client.KV().List(c.prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]string)
+	for _, p := range pairs {
+		keys[p.Key[len(c.prefix):]] = string(p.Value)
+	}
+
+	return keys, nil
+}
+
+// Watch blocks on Consul's blocking-query semantics, emitting an Event
+// for every key that's been added, changed, or removed since the last
+// observed index.
+func (c *ConsulBackend) Watch(ctx context.Context, events chan<- Event) {
+	var lastIndex uint64
+	seen := make(map[string]string)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		pairs, meta, err := c.client.KV().List(c.prefix, &api.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  5 * time.Minute,
+		})
+		if err != nil {
+			log.Printf("keysync: consul watch: %s", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		lastIndex = meta.LastIndex
+
+		current := make(map[string]string)
+		for _, p := range pairs {
+			name := p.Key[len(c.prefix):]
+			current[name] = string(p.Value)
+			if seen[name] != string(p.Value) {
+				events <- Event{Type: EventPut, Key: name, Name: string(p.Value)}
+			}
+		}
+
+		for name := range seen {
+			if _, ok := current[name]; !ok {
+				events <- Event{Type: EventDelete, Key: name}
+			}
+		}
+
+		seen = current
+	}
+}
@@ -0,0 +1,105 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package keysync syncs polymur-proxy API keys from a configurable
+// backend store into an in-memory lookup table used by the HTTP
+// listener to authenticate incoming requests.
+package keysync
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// ApiKeys holds the live set of API keys, keyed by the key itself with
+// the owning polymur-proxy name as the value.
+type ApiKeys struct {
+	sync.RWMutex
+	Keys map[string]string
+}
+
+// NewApiKeys returns an initialized *ApiKeys.
+func NewApiKeys() *ApiKeys {
+	return &ApiKeys{Keys: make(map[string]string)}
+}
+
+// EventType enumerates the kinds of changes a Backend reports via Watch.
+type EventType int
+
+const (
+	// EventPut indicates a key was added or its owning name changed.
+	EventPut EventType = iota
+	// EventDelete indicates a key was removed and should stop being
+	// honored immediately.
+	EventDelete
+)
+
+// Event describes a single key change emitted on a Backend's Watch
+// channel.
+type Event struct {
+	Type EventType
+	Key  string
+	Name string
+}
+
+// Backend is implemented by each supported API key store (Consul,
+// Vault, ...). Fetch performs a full initial load; Watch streams
+// incremental changes for the lifetime of ctx.
+type Backend interface {
+	Fetch(ctx context.Context) (map[string]string, error)
+	Watch(ctx context.Context, events chan<- Event)
+}
+
+// Run loads apiKeys from backend and keeps it in sync with it until ctx
+// is canceled.
+func Run(ctx context.Context, apiKeys *ApiKeys, backend Backend) {
+	keys, err := backend.Fetch(ctx)
+	if err != nil {
+		log.Printf("keysync: initial fetch failed: %s", err)
+	} else {
+		apiKeys.Lock()
+		for k, n := range keys {
+			apiKeys.Keys[k] = n
+		}
+		apiKeys.Unlock()
+	}
+
+	events := make(chan Event, 128)
+	go backend.Watch(ctx, events)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			apiKeys.Lock()
+			switch e.Type {
+			case EventPut:
+				apiKeys.Keys[e.Key] = e.Name
+			case EventDelete:
+				delete(apiKeys.Keys, e.Key)
+			}
+			apiKeys.Unlock()
+		}
+	}
+}
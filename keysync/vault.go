@@ -0,0 +1,283 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package keysync
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// VaultBackendConfig configures a VaultBackend.
+type VaultBackendConfig struct {
+	// Mount is the KV v2 secrets engine mount point, e.g. "secret".
+	Mount string
+	// Path is the path under Mount holding one secret per API key, e.g.
+	// "polymur/keys".
+	Path string
+	// RoleID and SecretID, when both set, authenticate via AppRole
+	// instead of VAULT_TOKEN.
+	RoleID   string
+	SecretID string
+}
+
+// VaultBackend reads API keys from a HashiCorp Vault KV v2 secrets
+// engine. Each secret under Mount/Path is expected to hold a "key"
+// field (the polymur-proxy API key) and a "name" field (the owning
+// name), matching the ApiKeys.Keys[key] = name contract.
+type VaultBackend struct {
+	client *vaultapi.Client
+	cfg    *VaultBackendConfig
+}
+
+// NewVaultBackend builds a VaultBackend, authenticating via VAULT_TOKEN
+// or, when cfg.RoleID/SecretID are set, via AppRole. ctx bounds the
+// lifetime of the background token-renewal loop it starts; cancel it
+// when the backend is discarded (e.g. on a config reload that
+// replaces it) to stop that goroutine.
+func NewVaultBackend(ctx context.Context, cfg *VaultBackendConfig) (*VaultBackend, error) {
+	client, err := vaultapi.NewClient(vaultapi.DefaultConfig())
+	if err != nil {
+		return nil, fmt.Errorf("keysync: vault client: %s", err)
+	}
+
+	if addr := os.Getenv("VAULT_ADDR"); addr != "" {
+		client.SetAddress(addr)
+	}
+
+	switch {
+	case cfg.RoleID != "" && cfg.SecretID != "":
+		if err := approleLogin(client, cfg.RoleID, cfg.SecretID); err != nil {
+			return nil, err
+		}
+	case os.Getenv("VAULT_TOKEN") != "":
+		client.SetToken(os.Getenv("VAULT_TOKEN"))
+	default:
+		return nil, fmt.Errorf("keysync: no VAULT_TOKEN and no -vault-role-id/-vault-secret-id supplied")
+	}
+
+	if cfg.Mount == "" {
+		cfg.Mount = "secret"
+	}
+	if cfg.Path == "" {
+		cfg.Path = "polymur/keys"
+	}
+
+	v := &VaultBackend{client: client, cfg: cfg}
+	go v.renewLoop(ctx)
+
+	return v, nil
+}
+
+// approleLogin exchanges an AppRole role/secret ID pair for a client
+// token and installs it on client.
+func approleLogin(client *vaultapi.Client, roleID, secretID string) error {
+	secret, err := client.Logical().Write("auth/approle/login", map[string]interface{}{
+		"role_id":   roleID,
+		"secret_id": secretID,
+	})
+	if err != nil {
+		return fmt.Errorf("keysync: approle login: %s", err)
+	}
+	if secret == nil || secret.Auth == nil {
+		return fmt.Errorf("keysync: approle login: empty auth response")
+	}
+
+	client.SetToken(secret.Auth.ClientToken)
+
+	return nil
+}
+
+// renewLoop keeps the Vault token alive, renewing on a ticker sized to
+// half its lease duration and falling back to a fresh AppRole login if
+// renewal fails outright. It exits once ctx is done, e.g. when a
+// config reload discards this VaultBackend for a new one.
+func (v *VaultBackend) renewLoop(ctx context.Context) {
+	for {
+		lease := 30 * time.Minute
+
+		secret, err := v.client.Auth().Token().RenewSelf(0)
+		switch {
+		case err == nil && secret != nil && secret.Auth != nil && secret.Auth.LeaseDuration > 0:
+			lease = time.Duration(secret.Auth.LeaseDuration) * time.Second / 2
+		case err != nil:
+			log.Printf("keysync: vault token renewal failed: %s", err)
+			if v.cfg.RoleID != "" && v.cfg.SecretID != "" {
+				if err := approleLogin(v.client, v.cfg.RoleID, v.cfg.SecretID); err != nil {
+					log.Printf("keysync: vault approle re-login failed: %s", err)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(lease):
+		}
+	}
+}
+
+// listPath returns the KV v2 metadata-list path for Mount/Path.
+func (v *VaultBackend) listPath() string {
+	return fmt.Sprintf("%s/metadata/%s", v.cfg.Mount, v.cfg.Path)
+}
+
+// dataPath returns the KV v2 data-read path for a single secret.
+func (v *VaultBackend) dataPath(name string) string {
+	return fmt.Sprintf("%s/data/%s/%s", v.cfg.Mount, v.cfg.Path, name)
+}
+
+// Fetch lists every secret under Mount/Path and reads its key/name
+// fields.
+func (v *VaultBackend) Fetch(ctx context.Context) (map[string]string, error) {
+	names, err := v.listSecrets()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]string)
+	for _, name := range names {
+		key, owner, destroyed, err := v.readSecret(name)
+		if err != nil {
+			log.Printf("keysync: vault read %s: %s", name, err)
+			continue
+		}
+		if destroyed || key == "" {
+			continue
+		}
+		keys[key] = owner
+	}
+
+	return keys, nil
+}
+
+func (v *VaultBackend) listSecrets() ([]string, error) {
+	secret, err := v.client.Logical().List(v.listPath())
+	if err != nil {
+		return nil, fmt.Errorf("keysync: vault list: %s", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+
+	raw, ok := secret.Data["keys"].([]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(raw))
+	for _, r := range raw {
+		if s, ok := r.(string); ok {
+			names = append(names, strings.TrimSuffix(s, "/"))
+		}
+	}
+
+	return names, nil
+}
+
+// readSecret fetches a single secret's current version and returns its
+// key/name fields. destroyed is true when the current version has been
+// deleted or destroyed, meaning the key should no longer be honored.
+func (v *VaultBackend) readSecret(name string) (key, owner string, destroyed bool, err error) {
+	secret, err := v.client.Logical().Read(v.dataPath(name))
+	if err != nil {
+		return "", "", false, err
+	}
+	if secret == nil || secret.Data == nil {
+		return "", "", true, nil
+	}
+
+	if meta, ok := secret.Data["metadata"].(map[string]interface{}); ok {
+		if meta["destroyed"] == true {
+			return "", "", true, nil
+		}
+		if dt, ok := meta["deletion_time"].(string); ok && dt != "" {
+			return "", "", true, nil
+		}
+	}
+
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return "", "", true, nil
+	}
+
+	key, _ = data["key"].(string)
+	owner, _ = data["name"].(string)
+
+	return key, owner, false, nil
+}
+
+// Watch polls Vault for changes, since KV v2 has no blocking-query
+// primitive like Consul's. Tombstoned or destroyed versions surface as
+// EventDelete so revocation propagates without a gateway restart.
+func (v *VaultBackend) Watch(ctx context.Context, events chan<- Event) {
+	seen := make(map[string]string)
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		names, err := v.listSecrets()
+		if err != nil {
+			log.Printf("keysync: vault watch: %s", err)
+			continue
+		}
+
+		current := make(map[string]string)
+		for _, name := range names {
+			key, owner, destroyed, err := v.readSecret(name)
+			if err != nil {
+				log.Printf("keysync: vault watch read %s: %s", name, err)
+				continue
+			}
+			if destroyed || key == "" {
+				if prevKey, ok := seen[name]; ok {
+					events <- Event{Type: EventDelete, Key: prevKey}
+				}
+				continue
+			}
+
+			current[name] = key
+			events <- Event{Type: EventPut, Key: key, Name: owner}
+		}
+
+		for name, key := range seen {
+			if _, ok := current[name]; !ok {
+				events <- Event{Type: EventDelete, Key: key}
+			}
+		}
+
+		seen = current
+	}
+}
@@ -0,0 +1,174 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package listener
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// serveACME runs the ingest mux behind a certificate automatically
+// issued and renewed via ACME, per cfg.ACME*.
+func serveACME(cfg *HTTPListenerConfig, mux http.Handler, addr string) {
+	cache, err := acmeCache(cfg)
+	if err != nil {
+		log.Fatalf("listener: acme: %s", err)
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.ACMEHosts...),
+		Cache:      cache,
+	}
+
+	tlsConfig := manager.TLSConfig()
+
+	if cfg.ACMEHTTP {
+		go func() {
+			log.Printf("listener: acme: serving HTTP-01 challenge responder on :80")
+			if err := http.ListenAndServe(":80", manager.HTTPHandler(nil)); err != nil {
+				log.Fatalf("listener: acme: HTTP-01 responder: %s", err)
+			}
+		}()
+	} else {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+	}
+
+	if cfg.UseCertAuthentication {
+		caCert, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			log.Fatalf("listener: acme: reading CA cert: %s", err)
+		}
+
+		caPool := x509.NewCertPool()
+		caPool.AppendCertsFromPEM(caCert)
+
+		tlsConfig.ClientCAs = caPool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+		// autocert's own GetCertificate already handles ACME and
+		// tls-alpn-01 negotiation; layering client-cert enforcement
+		// only requires the ClientCAs/ClientAuth fields above, since
+		// verification happens after GetCertificate during the
+		// handshake. The one exception is the tls-alpn-01 challenge
+		// handshake itself (-acme-http=false): the ACME CA validating
+		// it never presents a client cert, so RequireAndVerifyClientCert
+		// would fail issuance/renewal. Relax ClientAuth for just that
+		// handshake, identified by its acme-tls/1 ALPN protocol.
+		if !cfg.ACMEHTTP {
+			base := tlsConfig.Clone()
+			tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				for _, proto := range hello.SupportedProtos {
+					if proto == acme.ALPNProto {
+						relaxed := base.Clone()
+						relaxed.ClientAuth = tls.NoClientCert
+						return relaxed, nil
+					}
+				}
+				return nil, nil
+			}
+		}
+	}
+
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+
+	log.Printf("listener: acme: serving on %s for hosts %v", addr, cfg.ACMEHosts)
+
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		log.Fatalf("listener: acme: %s", err)
+	}
+}
+
+// acmeCache builds the autocert.Cache backend selected by cfg: a local
+// directory cache by default, or Consul KV when ACMECacheConsulAddr is
+// set.
+func acmeCache(cfg *HTTPListenerConfig) (autocert.Cache, error) {
+	if cfg.ACMECacheConsulAddr != "" {
+		return newConsulACMECache(cfg.ACMECacheConsulAddr)
+	}
+
+	dir := cfg.ACMECacheDir
+	if dir == "" {
+		dir = "/var/cache/polymur-gateway/acme"
+	}
+
+	return autocert.DirCache(dir), nil
+}
+
+// consulACMECache implements autocert.Cache on top of Consul's KV
+// store. It builds its own Consul client from the configured address;
+// the clients used for service discovery and key sync are not shared.
+type consulACMECache struct {
+	client *api.Client
+	prefix string
+}
+
+func newConsulACMECache(addr string) (*consulACMECache, error) {
+	conf := api.DefaultConfig()
+	conf.Address = addr
+
+	client, err := api.NewClient(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &consulACMECache{client: client, prefix: "polymur/acme/"}, nil
+}
+
+// Get implements autocert.Cache.
+func (c *consulACMECache) Get(ctx context.Context, key string) ([]byte, error) {
+	pair, _, err := c.client.KV().Get(c.prefix+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return nil, autocert.ErrCacheMiss
+	}
+
+	return pair.Value, nil
+}
+
+// Put implements autocert.Cache.
+func (c *consulACMECache) Put(ctx context.Context, key string, data []byte) error {
+	_, err := c.client.KV().Put(&api.KVPair{Key: c.prefix + key, Value: data}, nil)
+	return err
+}
+
+// Delete implements autocert.Cache.
+func (c *consulACMECache) Delete(ctx context.Context, key string) error {
+	_, err := c.client.KV().Delete(c.prefix+key, nil)
+	return err
+}
@@ -0,0 +1,225 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package listener serves the polymur-proxy ingest endpoint over HTTPS,
+// authenticating each request by API key, client TLS certificate, or
+// OIDC bearer token.
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/chrissnell/polymur/keysync"
+	"github.com/chrissnell/polymur/statstracker"
+)
+
+// AtomicBool holds a boolean that can be read from the request path and
+// updated concurrently, e.g. by a config hot-reload.
+type AtomicBool struct {
+	v int32
+}
+
+// NewAtomicBool returns an AtomicBool initialized to v.
+func NewAtomicBool(v bool) *AtomicBool {
+	b := &AtomicBool{}
+	b.Set(v)
+	return b
+}
+
+// Set updates the boolean value.
+func (b *AtomicBool) Set(v bool) {
+	i := int32(0)
+	if v {
+		i = 1
+	}
+	atomic.StoreInt32(&b.v, i)
+}
+
+// Get returns the current boolean value.
+func (b *AtomicBool) Get() bool {
+	return atomic.LoadInt32(&b.v) != 0
+}
+
+// HTTPListenerConfig configures HTTPListener.
+type HTTPListenerConfig struct {
+	Addr string
+	Port string
+
+	IncomingQueue chan []*string
+
+	Cert string
+	Key  string
+	CA   string
+
+	UseCertAuthentication bool
+	// KeyPrefix is held behind an AtomicBool so it can be toggled by a
+	// config reload without restarting the listener.
+	KeyPrefix *AtomicBool
+
+	// UseOIDCAuth, when set, authenticates requests by verifying an
+	// OIDC ID token in the Authorization header instead of an API key
+	// or client certificate.
+	UseOIDCAuth  bool
+	OIDCVerifier *OIDCVerifier
+
+	// ACME, when set, replaces Cert/Key with certificates issued
+	// automatically via ACME (e.g. Let's Encrypt).
+	ACME         bool
+	ACMEHosts    []string
+	ACMECacheDir string
+	// ACMECacheConsulAddr, if set, stores ACME account/certificate data
+	// in Consul KV instead of ACMECacheDir.
+	ACMECacheConsulAddr string
+	// ACMEHTTP serves the HTTP-01 challenge on :80 when true (the
+	// default). When false, only tls-alpn-01 is used, avoiding the need
+	// for a separate listener.
+	ACMEHTTP bool
+
+	Stats *statstracker.Stats
+	Keys  *keysync.ApiKeys
+}
+
+// HTTPListener serves the ingest endpoint, authenticating requests via
+// API key or, if cfg.UseCertAuthentication, client TLS certificates, or,
+// if cfg.UseOIDCAuth, OIDC bearer tokens.
+func HTTPListener(cfg *HTTPListenerConfig) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ingestHandler(cfg))
+
+	addr := net.JoinHostPort(cfg.Addr, cfg.Port)
+
+	if cfg.ACME {
+		serveACME(cfg, mux, addr)
+		return
+	}
+
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		log.Fatalf("listener: %s", err)
+	}
+
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+
+	log.Printf("listener: serving on %s", addr)
+
+	if err := server.ListenAndServeTLS(cfg.Cert, cfg.Key); err != nil {
+		log.Fatalf("listener: %s", err)
+	}
+}
+
+// newTLSConfig builds the base tls.Config for cfg, enforcing client
+// certificate verification against cfg.CA when cfg.UseCertAuthentication
+// is set.
+func newTLSConfig(cfg *HTTPListenerConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if cfg.UseCertAuthentication {
+		caCert, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA cert: %s", err)
+		}
+
+		caPool := x509.NewCertPool()
+		caPool.AppendCertsFromPEM(caCert)
+
+		tlsConfig.ClientCAs = caPool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// ingestHandler authenticates and accepts incoming metric batches,
+// queuing them on cfg.IncomingQueue.
+func ingestHandler(cfg *HTTPListenerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := authenticate(cfg, r)
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		msg := string(body)
+		if cfg.KeyPrefix.Get() && name != "" {
+			lines := strings.SplitAfter(msg, "\n")
+			for i, l := range lines {
+				if l != "" {
+					lines[i] = name + "." + l
+				}
+			}
+			msg = strings.Join(lines, "")
+		}
+
+		select {
+		case cfg.IncomingQueue <- []*string{&msg}:
+			cfg.Stats.IncReceived(name)
+		default:
+			cfg.Stats.Dropped.Add(1)
+			http.Error(w, "queue full", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// authenticate resolves the calling polymur-proxy's name from its OIDC
+// ID token, client certificate, or API key, depending on cfg.
+func authenticate(cfg *HTTPListenerConfig, r *http.Request) (name string, ok bool) {
+	switch {
+	case cfg.UseOIDCAuth:
+		return cfg.OIDCVerifier.Verify(r.Context(), r)
+
+	case cfg.UseCertAuthentication:
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return "", false
+		}
+		return r.TLS.PeerCertificates[0].Subject.CommonName, true
+
+	default:
+		key := r.Header.Get("X-polymur-apikey")
+
+		cfg.Keys.RLock()
+		name, known := cfg.Keys.Keys[key]
+		cfg.Keys.RUnlock()
+
+		return name, known
+	}
+}
@@ -0,0 +1,152 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package listener
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	oidc "github.com/coreos/go-oidc"
+)
+
+// OIDCVerifierConfig configures an OIDCVerifier.
+type OIDCVerifierConfig struct {
+	// Issuer is the OIDC issuer URL, e.g. "https://accounts.google.com".
+	Issuer string
+	// Audience is the expected "aud" claim, typically the client ID
+	// clients were issued tokens for.
+	Audience string
+	// AllowedSubjects is either a comma-delimited list of exact "sub"
+	// values, or (if it looks like one) a regex, matched against "sub".
+	// Empty allows any subject the issuer vouches for.
+	AllowedSubjects string
+}
+
+// OIDCVerifier authenticates polymur-proxy clients presenting an OIDC
+// ID token instead of an API key or client certificate. The token's
+// "sub" claim takes the place of the API key's owning name for
+// KeyPrefix and per-identity stats.
+type OIDCVerifier struct {
+	verifier *oidc.IDTokenVerifier
+
+	mu      sync.RWMutex
+	allowed func(sub string) bool
+}
+
+// NewOIDCVerifier discovers cfg.Issuer's OIDC configuration (including
+// its jwks_uri) and returns a verifier for tokens it issues. The
+// underlying key set is go-oidc's default remote key set, fetched
+// lazily and cached by go-oidc; no minimum refresh interval is set
+// here.
+func NewOIDCVerifier(ctx context.Context, cfg *OIDCVerifierConfig) (*OIDCVerifier, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("listener: oidc: discovering issuer %q: %s", cfg.Issuer, err)
+	}
+
+	allowed, err := allowedSubjectMatcher(cfg.AllowedSubjects)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCVerifier{
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.Audience}),
+		allowed:  allowed,
+	}, nil
+}
+
+// allowedSubjectMatcher builds a predicate from a comma list, or, if raw
+// contains regex metacharacters, a single compiled regex. Empty raw
+// allows any subject.
+func allowedSubjectMatcher(raw string) (func(string) bool, error) {
+	if raw == "" {
+		return func(string) bool { return true }, nil
+	}
+
+	if strings.ContainsAny(raw, "^$.*+?[]()|") {
+		re, err := regexp.Compile(raw)
+		if err != nil {
+			return nil, fmt.Errorf("listener: oidc: invalid -oidc-allowed-subjects regex: %s", err)
+		}
+		return re.MatchString, nil
+	}
+
+	allowed := make(map[string]bool)
+	for _, s := range strings.Split(raw, ",") {
+		allowed[strings.TrimSpace(s)] = true
+	}
+
+	return func(sub string) bool { return allowed[sub] }, nil
+}
+
+// Verify validates the bearer token in r's Authorization header and
+// returns its subject if the token's signature, exp, aud, and iss all
+// check out and the subject is allowed.
+func (v *OIDCVerifier) Verify(ctx context.Context, r *http.Request) (subject string, ok bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+
+	idToken, err := v.verifier.Verify(ctx, strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		return "", false
+	}
+
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return "", false
+	}
+
+	v.mu.RLock()
+	allowed := v.allowed(claims.Subject)
+	v.mu.RUnlock()
+
+	if !allowed {
+		return "", false
+	}
+
+	return claims.Subject, true
+}
+
+// SetAllowedSubjects recompiles the allowed-subjects predicate from raw,
+// letting -oidc-allowed-subjects change on a config reload without
+// tearing down the verifier (and its cached JWKS).
+func (v *OIDCVerifier) SetAllowedSubjects(raw string) error {
+	allowed, err := allowedSubjectMatcher(raw)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	v.allowed = allowed
+	v.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,277 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package output delivers batches read off the incoming queue to one or
+// more Graphite-compatible destinations.
+package output
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chrissnell/polymur/pool"
+)
+
+// AtomicEpsilon holds a hash-epsilon value that can be read from the
+// output loop and updated concurrently, e.g. by a config hot-reload.
+type AtomicEpsilon struct {
+	bits uint64
+}
+
+// NewAtomicEpsilon returns an AtomicEpsilon initialized to v.
+func NewAtomicEpsilon(v float64) *AtomicEpsilon {
+	e := &AtomicEpsilon{}
+	e.Set(v)
+	return e
+}
+
+// Set updates the epsilon value.
+func (e *AtomicEpsilon) Set(v float64) {
+	atomic.StoreUint64(&e.bits, math.Float64bits(v))
+}
+
+// Get returns the current epsilon value.
+func (e *AtomicEpsilon) Get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&e.bits))
+}
+
+// TCPWriterConfig configures TCPWriter.
+type TCPWriterConfig struct {
+	// Destinations is either a comma-delimited list of ip:port
+	// destinations, or a "consul://<service>?tag=...&dc=..." URL for
+	// dynamic, Consul-backed membership.
+	Destinations string
+	// Distribution selects how incoming batches are spread across
+	// Destinations: "broadcast" (send to all), "hash-route" (consistent
+	// hashing with bounded loads, keyed by metric name), or
+	// "legacy-hash" (the original modulo-based hash-route, kept for one
+	// release as a migration path).
+	Distribution  string
+	IncomingQueue chan []*string
+	QueueCap      int
+	// HashEpsilon bounds how far a destination's in-flight load may
+	// drift above the mean under "hash-route" before it's skipped in
+	// favor of the next vnode. Only meaningful for "hash-route". Held
+	// behind an AtomicEpsilon so it can be changed by a config reload
+	// without restarting TCPWriter.
+	HashEpsilon *AtomicEpsilon
+}
+
+// Console writes incoming batches to stdout instead of a Graphite
+// destination. Useful for local debugging.
+func Console(incomingQueue chan []*string) {
+	for msgs := range incomingQueue {
+		for _, m := range msgs {
+			fmt.Print(*m)
+		}
+	}
+}
+
+// TCPWriter registers cfg.Destinations in p (statically or via a
+// pool.Discoverer), dials a persistent connection to each, and
+// distributes everything read off cfg.IncomingQueue across them per
+// cfg.Distribution. ready is signaled once destinations have been
+// registered.
+func TCPWriter(p *pool.Pool, cfg *TCPWriterConfig, ready chan bool) {
+	consulCfg, isConsul, err := pool.ParseConsulDestinationURL(cfg.Destinations)
+	if err != nil {
+		log.Fatalf("output: %s", err)
+	}
+
+	if isConsul {
+		disc, err := pool.NewConsulDiscoverer(consulCfg)
+		if err != nil {
+			log.Fatalf("output: %s", err)
+		}
+		go runDiscoverer(p, disc, cfg)
+	} else {
+		for _, addr := range strings.Split(cfg.Destinations, ",") {
+			addr = strings.TrimSpace(addr)
+			if addr != "" {
+				registerDestination(p, addr, cfg)
+			}
+		}
+	}
+
+	ready <- true
+
+	for msgs := range cfg.IncomingQueue {
+		switch cfg.Distribution {
+		case "hash-route":
+			distributeHashRoute(p, msgs, cfg.HashEpsilon.Get())
+		case "legacy-hash":
+			distributeLegacyHash(p, msgs)
+		default:
+			distributeBroadcast(p, msgs)
+		}
+	}
+}
+
+// runDiscoverer keeps p in sync with disc's membership events for as
+// long as TCPWriter runs.
+func runDiscoverer(p *pool.Pool, disc pool.Discoverer, cfg *TCPWriterConfig) {
+	for e := range disc.Events() {
+		if e.Added {
+			registerDestination(p, e.Addr, cfg)
+		} else {
+			p.Unregister(e.Addr)
+		}
+	}
+}
+
+// registerDestination adds addr to p and starts its write loop.
+func registerDestination(p *pool.Pool, addr string, cfg *TCPWriterConfig) {
+	AddDestination(p, addr, cfg.QueueCap)
+}
+
+// AddDestination registers addr in p with the given queue capacity and
+// starts its write loop, if it isn't registered already. Exported so a
+// config reload can add statically-configured destinations without
+// restarting TCPWriter.
+func AddDestination(p *pool.Pool, addr string, queueCap int) {
+	if p.Has(addr) {
+		return
+	}
+
+	go writeLoop(p.Register(addr, queueCap))
+}
+
+// RemoveDestination unregisters addr from p, draining its queue. See
+// AddDestination.
+func RemoveDestination(p *pool.Pool, addr string) {
+	p.Unregister(addr)
+}
+
+// writeLoop maintains a persistent connection to c.Addr, redialing on
+// failure, and writes every batch it receives on c.Queue.
+func writeLoop(c *pool.Conn) {
+	for {
+		conn, err := net.DialTimeout("tcp", c.Addr, 5*time.Second)
+		if err != nil {
+			log.Printf("output: dial %s: %s", c.Addr, err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		var writeErr error
+		for msgs := range c.Queue {
+			for _, m := range msgs {
+				if _, err := conn.Write([]byte(*m)); err != nil {
+					writeErr = err
+					break
+				}
+			}
+			if writeErr != nil {
+				break
+			}
+		}
+
+		conn.Close()
+		if writeErr != nil {
+			log.Printf("output: write %s: %s", c.Addr, writeErr)
+		}
+	}
+}
+
+// distributeBroadcast fans msgs out to every registered destination.
+func distributeBroadcast(p *pool.Pool, msgs []*string) {
+	p.RLock()
+	defer p.RUnlock()
+
+	for _, c := range p.Conns {
+		select {
+		case c.Queue <- msgs:
+		default:
+			log.Printf("output: queue full for %s, dropping batch", c.Addr)
+		}
+	}
+}
+
+// distributeHashRoute sends msgs to a single destination, chosen by
+// consistent hashing with bounded loads over the metric name in the
+// batch: see pool.Pool.PickHashRoute.
+func distributeHashRoute(p *pool.Pool, msgs []*string, epsilon float64) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	c, ok := p.PickHashRoute(metricName(*msgs[0]), epsilon)
+	if !ok {
+		return
+	}
+
+	select {
+	case c.Queue <- msgs:
+	default:
+		log.Printf("output: queue full for %s, dropping batch", c.Addr)
+	}
+}
+
+// metricName returns the first whitespace-delimited field of msg, which
+// for a Graphite plaintext line is its metric name.
+func metricName(msg string) string {
+	if i := strings.IndexAny(msg, " \t\n"); i >= 0 {
+		return msg[:i]
+	}
+	return msg
+}
+
+// distributeLegacyHash sends msgs to a single destination, selected by
+// hashing the first metric name in the batch modulo the sorted set of
+// registered destinations. Kept under -distribution=legacy-hash as a
+// migration path off of the modulo scheme, which remaps the entire
+// keyspace whenever a destination is added or removed.
+func distributeLegacyHash(p *pool.Pool, msgs []*string) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+
+	if len(p.Conns) == 0 {
+		return
+	}
+
+	addrs := make([]string, 0, len(p.Conns))
+	for addr := range p.Conns {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	h := fnv.New32a()
+	h.Write([]byte(metricName(*msgs[0])))
+	addr := addrs[h.Sum32()%uint32(len(addrs))]
+
+	select {
+	case p.Conns[addr].Queue <- msgs:
+	default:
+		log.Printf("output: queue full for %s, dropping batch", addr)
+	}
+}
@@ -0,0 +1,220 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pool
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ConsulDiscovererConfig configures a ConsulDiscoverer.
+type ConsulDiscovererConfig struct {
+	// Addr is the Consul HTTP API address, e.g. "localhost:8500". Empty
+	// defers to the client's default (CONSUL_HTTP_ADDR or
+	// localhost:8500).
+	Addr string
+	// Service is the Consul service name to watch.
+	Service string
+	// Tag, if set, restricts results to instances carrying it.
+	Tag string
+	// Datacenter, if set, queries a specific Consul datacenter.
+	Datacenter string
+
+	// CA, Cert, and Key, when all set, are used to reach a
+	// TLS-secured Consul API.
+	CA   string
+	Cert string
+	Key  string
+}
+
+// ParseConsulDestinationURL parses a "consul://<service>?tag=prod&dc=us-east"
+// -destinations value into a ConsulDiscovererConfig. ok is false (with a
+// nil error) if raw isn't a consul:// URL, so callers can fall back to
+// treating it as a static destination list.
+func ParseConsulDestinationURL(raw string) (cfg *ConsulDiscovererConfig, ok bool, err error) {
+	if !strings.HasPrefix(raw, "consul://") {
+		return nil, false, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, true, fmt.Errorf("pool: invalid consul destination %q: %s", raw, err)
+	}
+
+	q := u.Query()
+
+	return &ConsulDiscovererConfig{
+		Addr:       q.Get("addr"),
+		Service:    u.Host,
+		Tag:        q.Get("tag"),
+		Datacenter: q.Get("dc"),
+		CA:         q.Get("ca"),
+		Cert:       q.Get("cert"),
+		Key:        q.Get("key"),
+	}, true, nil
+}
+
+// ConsulDiscoverer watches a Consul service's health catalog via
+// blocking queries and emits Events as passing instances are added or
+// removed.
+type ConsulDiscoverer struct {
+	cfg    *ConsulDiscovererConfig
+	client *api.Client
+	events chan Event
+	cancel context.CancelFunc
+}
+
+// NewConsulDiscoverer starts watching cfg.Service and returns a
+// Discoverer streaming its membership changes.
+func NewConsulDiscoverer(cfg *ConsulDiscovererConfig) (*ConsulDiscoverer, error) {
+	conf := api.DefaultConfig()
+	if cfg.Addr != "" {
+		conf.Address = cfg.Addr
+	}
+	if cfg.Datacenter != "" {
+		conf.Datacenter = cfg.Datacenter
+	}
+	if cfg.CA != "" && cfg.Cert != "" && cfg.Key != "" {
+		conf.TLSConfig = api.TLSConfig{
+			CAFile:   cfg.CA,
+			CertFile: cfg.Cert,
+			KeyFile:  cfg.Key,
+		}
+	}
+
+	client, err := api.NewClient(conf)
+	if err != nil {
+		return nil, fmt.Errorf("pool: consul client: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d := &ConsulDiscoverer{
+		cfg:    cfg,
+		client: client,
+		events: make(chan Event, 32),
+		cancel: cancel,
+	}
+
+	go d.watch(ctx)
+
+	return d, nil
+}
+
+// Events implements Discoverer.
+func (d *ConsulDiscoverer) Events() <-chan Event {
+	return d.events
+}
+
+// Stop implements Discoverer. It cancels the context carried by the
+// watch goroutine's in-flight blocking query, interrupting it rather
+// than waiting for it to run out its wait time.
+func (d *ConsulDiscoverer) Stop() {
+	d.cancel()
+}
+
+// watch runs Consul blocking queries against the service's health
+// catalog, diffing results against the previously seen set and
+// emitting Events for additions and removals. A failed health check
+// simply drops the instance from the "passing" result set, so it's
+// reported as removed the same as if it had left the catalog.
+func (d *ConsulDiscoverer) watch(ctx context.Context) {
+	var lastIndex uint64
+	seen := make(map[string]bool)
+
+	health := d.client.Health()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		opts := (&api.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  5 * time.Minute,
+		}).WithContext(ctx)
+
+		entries, meta, err := health.Service(d.cfg.Service, d.cfg.Tag, true, opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("pool: consul discoverer: %s", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		lastIndex = meta.LastIndex
+
+		hostports := make([]string, len(entries))
+		for i, e := range entries {
+			addr := e.Service.Address
+			if addr == "" {
+				addr = e.Node.Address
+			}
+			hostports[i] = fmt.Sprintf("%s:%d", addr, e.Service.Port)
+		}
+
+		current, added, removed := diffMembership(seen, hostports)
+
+		for _, hostport := range added {
+			d.events <- Event{Addr: hostport, Added: true}
+		}
+		for _, hostport := range removed {
+			d.events <- Event{Addr: hostport, Added: false}
+		}
+
+		seen = current
+	}
+}
+
+// diffMembership compares seen (the hostport set from the previous
+// poll) against hostports (the current poll's entries, in response
+// order) and reports which hostports were added or removed, plus the
+// current set to carry into the next poll.
+func diffMembership(seen map[string]bool, hostports []string) (current map[string]bool, added, removed []string) {
+	current = make(map[string]bool, len(hostports))
+
+	for _, hostport := range hostports {
+		current[hostport] = true
+		if !seen[hostport] {
+			added = append(added, hostport)
+		}
+	}
+
+	for hostport := range seen {
+		if !current[hostport] {
+			removed = append(removed, hostport)
+		}
+	}
+
+	return current, added, removed
+}
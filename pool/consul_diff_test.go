@@ -0,0 +1,73 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pool
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDiffMembershipAddsAndRemoves(t *testing.T) {
+	seen := map[string]bool{"a:1": true, "b:1": true}
+	hostports := []string{"b:1", "c:1"}
+
+	current, added, removed := diffMembership(seen, hostports)
+
+	if want := (map[string]bool{"b:1": true, "c:1": true}); !reflect.DeepEqual(current, want) {
+		t.Fatalf("current = %v, want %v", current, want)
+	}
+	if want := []string{"c:1"}; !reflect.DeepEqual(added, want) {
+		t.Fatalf("added = %v, want %v", added, want)
+	}
+	if want := []string{"a:1"}; !reflect.DeepEqual(removed, want) {
+		t.Fatalf("removed = %v, want %v", removed, want)
+	}
+}
+
+func TestDiffMembershipFirstPoll(t *testing.T) {
+	current, added, removed := diffMembership(nil, []string{"a:1", "b:1"})
+
+	sort.Strings(added)
+	if want := []string{"a:1", "b:1"}; !reflect.DeepEqual(added, want) {
+		t.Fatalf("added = %v, want %v", added, want)
+	}
+	if removed != nil {
+		t.Fatalf("removed = %v, want nil", removed)
+	}
+	if len(current) != 2 {
+		t.Fatalf("current = %v, want 2 entries", current)
+	}
+}
+
+func TestDiffMembershipNoChange(t *testing.T) {
+	seen := map[string]bool{"a:1": true}
+	_, added, removed := diffMembership(seen, []string{"a:1"})
+
+	if added != nil {
+		t.Fatalf("added = %v, want nil", added)
+	}
+	if removed != nil {
+		t.Fatalf("removed = %v, want nil", removed)
+	}
+}
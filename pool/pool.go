@@ -0,0 +1,115 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package pool tracks the set of live Graphite destination connections
+// shared between the output writer, its distribution strategy, and the
+// API server.
+package pool
+
+import "sync"
+
+// Conn represents a single outbound connection to a Graphite-compatible
+// destination.
+type Conn struct {
+	Addr  string
+	Queue chan []*string
+}
+
+// Pool is the registry of currently active destination connections.
+type Pool struct {
+	sync.RWMutex
+	Conns map[string]*Conn
+
+	// ring caches the consistent-hash ring built from Conns' membership.
+	// It's invalidated (set to nil) by Register/Unregister and rebuilt
+	// lazily on the next PickHashRoute call.
+	ring *ring
+}
+
+// NewPool returns an empty *Pool.
+func NewPool() *Pool {
+	return &Pool{Conns: make(map[string]*Conn)}
+}
+
+// Register adds addr to the pool with a queue of the given capacity and
+// returns its Conn. If addr is already registered, the existing Conn is
+// returned unchanged.
+func (p *Pool) Register(addr string, queueCap int) *Conn {
+	p.Lock()
+	defer p.Unlock()
+
+	if c, ok := p.Conns[addr]; ok {
+		return c
+	}
+
+	c := &Conn{Addr: addr, Queue: make(chan []*string, queueCap)}
+	p.Conns[addr] = c
+	p.ring = nil
+
+	return c
+}
+
+// Unregister removes addr from the pool and drains any batches still
+// sitting in its queue.
+func (p *Pool) Unregister(addr string) {
+	p.Lock()
+	c, ok := p.Conns[addr]
+	if ok {
+		delete(p.Conns, addr)
+		p.ring = nil
+	}
+	p.Unlock()
+
+	if !ok {
+		return
+	}
+
+	for {
+		select {
+		case <-c.Queue:
+		default:
+			return
+		}
+	}
+}
+
+// Has reports whether addr is currently registered.
+func (p *Pool) Has(addr string) bool {
+	p.RLock()
+	defer p.RUnlock()
+
+	_, ok := p.Conns[addr]
+	return ok
+}
+
+// List returns the currently registered destination addresses.
+func (p *Pool) List() []string {
+	p.RLock()
+	defer p.RUnlock()
+
+	addrs := make([]string, 0, len(p.Conns))
+	for addr := range p.Conns {
+		addrs = append(addrs, addr)
+	}
+
+	return addrs
+}
@@ -0,0 +1,208 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pool
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// vnodesPerDest is the number of virtual nodes hashed onto the ring for
+// each destination.
+const vnodesPerDest = 160
+
+// ring is a consistent-hash ring built from a Pool's current
+// destinations. Building it from many vnodes per destination means
+// that adding or removing a destination only remaps the keys that
+// landed on its own vnodes, rather than the whole keyspace.
+type ring struct {
+	nodes []ringNode
+}
+
+type ringNode struct {
+	hash uint64
+	addr string
+}
+
+func fnv64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// buildRing hashes vnodesPerDest virtual nodes per address and sorts
+// them into ring order.
+func buildRing(addrs []string) *ring {
+	nodes := make([]ringNode, 0, len(addrs)*vnodesPerDest)
+	for _, addr := range addrs {
+		for i := 0; i < vnodesPerDest; i++ {
+			nodes = append(nodes, ringNode{
+				hash: fnv64(addr + "#" + strconv.Itoa(i)),
+				addr: addr,
+			})
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].hash < nodes[j].hash })
+
+	return &ring{nodes: nodes}
+}
+
+// walk returns the ring's destination addresses in clockwise order
+// starting from the first vnode at or after key's hash, de-duplicated
+// to one entry per destination. This is the probe order used to satisfy
+// the bounded-loads invariant.
+func (r *ring) walk(key string) []string {
+	if len(r.nodes) == 0 {
+		return nil
+	}
+
+	h := fnv64(key)
+	idx := sort.Search(len(r.nodes), func(i int) bool { return r.nodes[i].hash >= h })
+	if idx == len(r.nodes) {
+		idx = 0
+	}
+
+	seen := make(map[string]bool, len(r.nodes))
+	order := make([]string, 0, len(r.nodes))
+
+	for i := 0; i < len(r.nodes); i++ {
+		addr := r.nodes[(idx+i)%len(r.nodes)].addr
+		if !seen[addr] {
+			seen[addr] = true
+			order = append(order, addr)
+		}
+	}
+
+	return order
+}
+
+// PickHashRoute selects the destination for key under consistent
+// hashing with bounded loads: starting from key's vnode, it walks the
+// ring clockwise and returns the first destination whose in-flight
+// queue depth doesn't exceed ceil(avg * (1 + epsilon)). If every
+// destination is already over that bound, it falls back to key's
+// primary vnode rather than dropping the batch.
+//
+// The ring itself is built once per pool membership and cached on the
+// Pool; Register/Unregister invalidate the cache, so a typical call
+// only pays for a sort.Search walk, not a full rebuild. p.Conns is read
+// in its entirety under a single p.RLock, matching distributeBroadcast
+// and distributeLegacyHash in output/output.go, since Register/
+// Unregister can mutate it concurrently from another goroutine (e.g.
+// the Consul discoverer) while this runs.
+func (p *Pool) PickHashRoute(key string, epsilon float64) (*Conn, bool) {
+	r := p.ringOrBuild()
+	if r == nil {
+		return nil, false
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+
+	conns := p.Conns
+	if len(conns) == 0 {
+		return nil, false
+	}
+
+	order := r.walk(key)
+
+	total := 0
+	for _, c := range conns {
+		total += len(c.Queue)
+	}
+	limit := int(math.Ceil(float64(total) / float64(len(conns)) * (1 + epsilon)))
+
+	for _, addr := range order {
+		if c, ok := conns[addr]; ok && len(c.Queue) <= limit {
+			return c, true
+		}
+	}
+
+	// Every destination in order is over the bound, or the ring used
+	// is stale relative to a just-changed pool membership; fall back
+	// to any currently registered destination rather than dropping
+	// the batch or indexing a no-longer-registered address.
+	for _, addr := range order {
+		if c, ok := conns[addr]; ok {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+// ringOrBuild returns the pool's cached ring, building and caching it
+// first if the pool is non-empty and none is cached yet. It never
+// holds both p.RLock and p.Lock at once, since cachedRing acquires
+// p.Lock itself.
+func (p *Pool) ringOrBuild() *ring {
+	p.RLock()
+	r := p.ring
+	n := len(p.Conns)
+	p.RUnlock()
+
+	if n == 0 {
+		return nil
+	}
+	if r != nil {
+		return r
+	}
+
+	return p.cachedRing()
+}
+
+// cachedRing rebuilds and caches the ring for the pool's current
+// membership if it isn't already cached, and returns it.
+func (p *Pool) cachedRing() *ring {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.ring != nil {
+		return p.ring
+	}
+
+	addrs := make([]string, 0, len(p.Conns))
+	for addr := range p.Conns {
+		addrs = append(addrs, addr)
+	}
+	p.ring = buildRing(addrs)
+
+	return p.ring
+}
+
+// RingMembership returns the current vnode density and per-destination
+// queue depth, for the API server's debugging endpoint.
+func (p *Pool) RingMembership() (vnodesPerDestination int, load map[string]int) {
+	p.RLock()
+	defer p.RUnlock()
+
+	load = make(map[string]int, len(p.Conns))
+	for addr, c := range p.Conns {
+		load[addr] = len(c.Queue)
+	}
+
+	return vnodesPerDest, load
+}
@@ -0,0 +1,158 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pool
+
+import "testing"
+
+func TestRingWalkVisitsEveryDestinationOnce(t *testing.T) {
+	addrs := []string{"a:1", "b:1", "c:1"}
+	r := buildRing(addrs)
+
+	order := r.walk("some-metric-key")
+	if len(order) != len(addrs) {
+		t.Fatalf("walk returned %d destinations, want %d", len(order), len(addrs))
+	}
+
+	seen := make(map[string]bool, len(order))
+	for _, addr := range order {
+		if seen[addr] {
+			t.Fatalf("walk returned %q more than once: %v", addr, order)
+		}
+		seen[addr] = true
+	}
+}
+
+func TestRingWalkEmpty(t *testing.T) {
+	r := buildRing(nil)
+	if order := r.walk("x"); order != nil {
+		t.Fatalf("walk on empty ring = %v, want nil", order)
+	}
+}
+
+func TestRingWalkIsStablePerKey(t *testing.T) {
+	addrs := []string{"a:1", "b:1", "c:1", "d:1"}
+	r := buildRing(addrs)
+
+	first := r.walk("same-key")
+	second := r.walk("same-key")
+
+	if len(first) != len(second) {
+		t.Fatalf("walk order length changed between calls: %v vs %v", first, second)
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("walk order changed between calls for same key: %v vs %v", first, second)
+		}
+	}
+}
+
+func TestPickHashRouteBoundedLoads(t *testing.T) {
+	p := NewPool()
+	a := p.Register("a:1", 10)
+	b := p.Register("b:1", 10)
+	c := p.Register("c:1", 10)
+
+	// Put 5 batches on each of a and b, over the epsilon-0 bound of
+	// ceil(10/3) = 4, so bounded loads must route around them to c,
+	// regardless of which destination the key's primary vnode lands on.
+	for i := 0; i < 5; i++ {
+		a.Queue <- nil
+		b.Queue <- nil
+	}
+
+	conn, ok := p.PickHashRoute("overloaded-key", 0)
+	if !ok {
+		t.Fatal("PickHashRoute returned ok=false with a non-empty pool")
+	}
+	if conn.Addr != c.Addr {
+		t.Fatalf("PickHashRoute = %s, want the only under-limit destination %s", conn.Addr, c.Addr)
+	}
+}
+
+func TestPickHashRouteEmptyPool(t *testing.T) {
+	p := NewPool()
+	if _, ok := p.PickHashRoute("key", 0); ok {
+		t.Fatal("PickHashRoute on an empty pool returned ok=true")
+	}
+}
+
+func TestPickHashRouteCachesRingUntilMembershipChanges(t *testing.T) {
+	p := NewPool()
+	p.Register("a:1", 10)
+	p.Register("b:1", 10)
+
+	if _, ok := p.PickHashRoute("key", 0); !ok {
+		t.Fatal("PickHashRoute returned ok=false")
+	}
+	r1 := p.ring
+	if r1 == nil {
+		t.Fatal("PickHashRoute did not populate the ring cache")
+	}
+
+	if _, ok := p.PickHashRoute("key", 0); !ok {
+		t.Fatal("PickHashRoute returned ok=false")
+	}
+	if p.ring != r1 {
+		t.Fatal("ring was rebuilt on a call with unchanged pool membership")
+	}
+
+	p.Register("c:1", 10)
+	if p.ring != nil {
+		t.Fatal("Register did not invalidate the cached ring")
+	}
+
+	if _, ok := p.PickHashRoute("key", 0); !ok {
+		t.Fatal("PickHashRoute returned ok=false")
+	}
+	if p.ring == r1 {
+		t.Fatal("ring was not rebuilt after pool membership changed")
+	}
+}
+
+// TestPickHashRouteConcurrentMembershipChanges exercises PickHashRoute
+// racing against Register/Unregister, e.g. a Consul discoverer
+// reconciling destinations while the output writer is routing
+// batches. Run with -race: this reproduces a concurrent map read/write
+// if PickHashRoute ever reads p.Conns after releasing its RLock.
+func TestPickHashRouteConcurrentMembershipChanges(t *testing.T) {
+	p := NewPool()
+	for i := 0; i < 4; i++ {
+		p.Register(string(rune('a'+i))+":1", 10)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			addr := string(rune('a'+(i%4))) + ":1"
+			p.Unregister(addr)
+			p.Register(addr, 10)
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		p.PickHashRoute("some-metric-key", 0.25)
+	}
+
+	<-done
+}
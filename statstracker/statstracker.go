@@ -0,0 +1,111 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Jamie Alquiza
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package statstracker maintains running throughput counters for the
+// gateway's data path and periodically logs them against the
+// destination pool.
+package statstracker
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chrissnell/polymur/pool"
+)
+
+// Counter is a simple atomic, monotonically-increasing counter.
+type Counter struct {
+	v int64
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.v, n)
+}
+
+// Get returns the counter's current value.
+func (c *Counter) Get() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+// Stats holds the running counters for the gateway's data path.
+type Stats struct {
+	Received Counter
+	Dropped  Counter
+	Sent     Counter
+
+	identityMu sync.Mutex
+	byIdentity map[string]*Counter
+}
+
+// IncReceived bumps Received and, if identity is non-empty, that
+// identity's own received counter. identity is whatever authenticate
+// resolved the request to: an API key's owning name, a certificate's
+// CommonName, or an OIDC token's "sub".
+func (s *Stats) IncReceived(identity string) {
+	s.Received.Add(1)
+
+	if identity == "" {
+		return
+	}
+
+	s.identityMu.Lock()
+	if s.byIdentity == nil {
+		s.byIdentity = make(map[string]*Counter)
+	}
+	c, ok := s.byIdentity[identity]
+	if !ok {
+		c = &Counter{}
+		s.byIdentity[identity] = c
+	}
+	s.identityMu.Unlock()
+
+	c.Add(1)
+}
+
+// ByIdentity returns the current received count for each identity seen
+// so far.
+func (s *Stats) ByIdentity() map[string]int64 {
+	s.identityMu.Lock()
+	defer s.identityMu.Unlock()
+
+	out := make(map[string]int64, len(s.byIdentity))
+	for name, c := range s.byIdentity {
+		out[name] = c.Get()
+	}
+
+	return out
+}
+
+// StatsTracker periodically logs throughput against p's registered
+// destinations.
+func StatsTracker(p *pool.Pool, stats *Stats) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		log.Printf("stats: received=%d sent=%d dropped=%d destinations=%d",
+			stats.Received.Get(), stats.Sent.Get(), stats.Dropped.Get(), len(p.List()))
+	}
+}